@@ -2,21 +2,43 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/fullstorydev/grpchan/inprocgrpc"
 	grpcMiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/pires/go-proxyproto"
 	"github.com/ringbrew/gsv/discovery"
 	"github.com/ringbrew/gsv/logger"
 	"github.com/ringbrew/gsv/service"
 	"github.com/ringbrew/gsv/tracex"
+	"github.com/soheilhy/cmux"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/netutil"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	channelzService "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/stats"
 	"log"
 	"net"
 	"net/http"
 	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConcurrentStreams = 1000
+	defaultMaxMsgSize           = 4 * 1024 * 1024
 )
 
 type grpcServer struct {
@@ -30,26 +52,59 @@ type grpcServer struct {
 	register           discovery.Register
 	traceOption        tracex.Option
 
-	enableGateway bool
-	gSrvGateway   *http.Server
-	gatewayMux    *runtime.ServeMux
-	serviceList   []service.Service
+	enableGateway  bool
+	gSrvGateway    *http.Server
+	gatewayMux     *runtime.ServeMux
+	gatewayHandler http.Handler
+	serviceList    []service.Service
+
+	enableMux bool
+	inproc    *inprocgrpc.Channel
+
+	tlsConfig           *tls.Config
+	enableProxyProtocol bool
+
+	healthSrv        *health.Server
+	enableReflection bool
+	enableChannelz   bool
+	grpcOpts         []grpc.ServerOption
+
+	muxer  cmux.CMux
+	rootLn net.Listener
+	grpcLn net.Listener
+	httpLn net.Listener
+
+	maxConnections int
+
+	servicesRegistered bool
 }
 
 func newGrpcServer(opt Option) *grpcServer {
 	s := &grpcServer{
-		port:               opt.Port,
-		proxyPort:          opt.ProxyPort,
-		streamInterceptors: opt.StreamInterceptors,
-		unaryInterceptors:  opt.UnaryInterceptors,
-		statHandler:        opt.StatHandler,
-		register:           opt.ServerRegister,
-		enableGateway:      opt.EnableGrpcGateway,
-		traceOption:        opt.TraceOption,
+		port:                opt.Port,
+		proxyPort:           opt.ProxyPort,
+		streamInterceptors:  opt.StreamInterceptors,
+		unaryInterceptors:   opt.UnaryInterceptors,
+		statHandler:         opt.StatHandler,
+		register:            opt.ServerRegister,
+		enableGateway:       opt.EnableGrpcGateway,
+		traceOption:         opt.TraceOption,
+		enableMux:           opt.EnableMux || (opt.EnableGrpcGateway && opt.ProxyPort == opt.Port),
+		enableProxyProtocol: opt.EnableProxyProtocol,
+		maxConnections:      opt.MaxConnections,
 	}
 
 	s.host = s.findListenOn()
 
+	if opt.TLSConfig != nil {
+		cfg := opt.TLSConfig.Clone()
+		if opt.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			cfg.ClientCAs = opt.ClientCAs
+		}
+		s.tlsConfig = cfg
+	}
+
 	opts := make([]grpc.ServerOption, 0)
 
 	if len(s.unaryInterceptors) > 0 {
@@ -64,25 +119,107 @@ func newGrpcServer(opt Option) *grpcServer {
 		opts = append(opts, grpc.StatsHandler(opt.StatHandler))
 	}
 
-	s.gSrv = grpc.NewServer(opts...)
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+
+	if s.traceOption.Enable {
+		opts = append(opts, grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	}
+
+	maxConcurrentStreams := opt.MaxConcurrentStreams
+	if maxConcurrentStreams == 0 {
+		maxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+	opts = append(opts, grpc.MaxConcurrentStreams(maxConcurrentStreams))
+
+	maxRecvMsgSize := opt.MaxRecvMsgSize
+	if maxRecvMsgSize == 0 {
+		maxRecvMsgSize = defaultMaxMsgSize
+	}
+	opts = append(opts, grpc.MaxRecvMsgSize(maxRecvMsgSize))
+
+	maxSendMsgSize := opt.MaxSendMsgSize
+	if maxSendMsgSize == 0 {
+		maxSendMsgSize = defaultMaxMsgSize
+	}
+	opts = append(opts, grpc.MaxSendMsgSize(maxSendMsgSize))
+
+	opts = append(opts, grpc.KeepaliveParams(opt.KeepaliveParams))
+	opts = append(opts, grpc.KeepaliveEnforcementPolicy(opt.KeepaliveEnforcementPolicy))
+
+	s.grpcOpts = opts
+	s.enableReflection = opt.EnableReflection
+	s.enableChannelz = opt.EnableChannelz
+	if opt.EnableHealth {
+		s.healthSrv = health.NewServer()
+	}
+
+	s.gSrv = s.newGrpcServerInstance()
+
+	s.inproc = &inprocgrpc.Channel{}
+	if len(s.unaryInterceptors) > 0 {
+		s.inproc = s.inproc.WithServerUnaryInterceptor(grpcMiddleware.ChainUnaryServer(s.unaryInterceptors...))
+	}
+	if len(s.streamInterceptors) > 0 {
+		s.inproc = s.inproc.WithServerStreamInterceptor(grpcMiddleware.ChainStreamServer(s.streamInterceptors...))
+	}
 
 	if s.enableGateway {
 		m := runtime.NewServeMux()
 		httpMux := http.NewServeMux()
 		httpMux.Handle("/", m)
 
-		hs := &http.Server{
-			Addr:    fmt.Sprintf(":%d", s.proxyPort),
-			Handler: s.recoverMiddleware(s.traceMiddleware(httpMux)),
+		if opt.EnableHealth {
+			httpMux.HandleFunc("/healthz", s.healthzHandler)
+			httpMux.HandleFunc("/readyz", s.readyzHandler)
 		}
 
 		s.gatewayMux = m
-		s.gSrvGateway = hs
+		s.gatewayHandler = s.recoverMiddleware(s.traceMiddleware(httpMux))
+		s.gSrvGateway = s.newGatewayServerInstance()
 	}
 
 	return s
 }
 
+// newGrpcServerInstance builds a fresh *grpc.Server from the stored options,
+// re-registering health/reflection/channelz on it. Run calls this on every
+// invocation rather than reusing gSrv, since grpc-go servers can't be
+// restarted once GracefulStop has returned.
+func (gs *grpcServer) newGrpcServerInstance() *grpc.Server {
+	srv := grpc.NewServer(gs.grpcOpts...)
+
+	if gs.healthSrv != nil {
+		healthpb.RegisterHealthServer(srv, gs.healthSrv)
+	}
+
+	if gs.enableReflection {
+		reflection.Register(srv)
+	}
+
+	if gs.enableChannelz {
+		channelzService.RegisterChannelzServiceToServer(srv)
+	}
+
+	return srv
+}
+
+// newGatewayServerInstance builds a fresh *http.Server for the gateway. Like
+// newGrpcServerInstance, Run calls this on every invocation rather than
+// reusing gSrvGateway, since net/http servers can't be reused once Shutdown
+// has returned.
+func (gs *grpcServer) newGatewayServerInstance() *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", gs.proxyPort),
+		Handler:           gs.gatewayHandler,
+		TLSConfig:         gs.tlsConfig,
+		MaxHeaderBytes:    1 << 20,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
 func (gs *grpcServer) recoverMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -95,13 +232,130 @@ func (gs *grpcServer) recoverMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+type traceResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *traceResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
 func (gs *grpcServer) traceMiddleware(h http.Handler) http.Handler {
+	if !gs.traceOption.Enable {
+		return h
+	}
+
+	tracer := otel.Tracer("github.com/ringbrew/gsv/server")
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//todo pass the trace info.
-		h.ServeHTTP(w, r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+		md := metadata.MD{}
+		for k, v := range carrier {
+			md.Set(k, v)
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+
+		peerIP := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			peerIP = host
+		}
+
+		wrapped := &traceResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		span.SetAttributes(
+			attribute.Int("http.status_code", wrapped.status),
+			attribute.String("http.route", r.URL.Path),
+			attribute.String("net.peer.ip", peerIP),
+		)
 	})
 }
 
+func (gs *grpcServer) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (gs *grpcServer) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	if gs.healthSrv == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+		return
+	}
+
+	for i := range gs.serviceList {
+		desc := gs.serviceList[i].Description()
+		for j := range desc.GrpcServiceDesc {
+			resp, err := gs.healthSrv.Check(context.Background(), &healthpb.HealthCheckRequest{Service: desc.GrpcServiceDesc[j].ServiceName})
+			if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("not ready"))
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (gs *grpcServer) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	if gs.healthSrv == nil {
+		return
+	}
+
+	gs.healthSrv.SetServingStatus(service, status)
+}
+
+func (gs *grpcServer) setAllServing(status healthpb.HealthCheckResponse_ServingStatus) {
+	if gs.healthSrv == nil {
+		return
+	}
+
+	for i := range gs.serviceList {
+		desc := gs.serviceList[i].Description()
+		for j := range desc.GrpcServiceDesc {
+			gs.healthSrv.SetServingStatus(desc.GrpcServiceDesc[j].ServiceName, status)
+		}
+	}
+}
+
+func (gs *grpcServer) wrapListener(lis net.Listener) net.Listener {
+	if !gs.enableProxyProtocol {
+		return lis
+	}
+
+	return &proxyproto.Listener{Listener: lis}
+}
+
+func (gs *grpcServer) wrapGrpcListener(lis net.Listener) net.Listener {
+	lis = gs.wrapListener(lis)
+
+	if gs.maxConnections > 0 {
+		lis = netutil.LimitListener(lis, gs.maxConnections)
+	}
+
+	return lis
+}
+
 func (gs *grpcServer) Register(srv service.Service) error {
 	desc := srv.Description()
 	if !desc.Valid {
@@ -117,12 +371,72 @@ func (gs *grpcServer) Register(srv service.Service) error {
 	return nil
 }
 
-func (gs *grpcServer) Run(ctx context.Context) {
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+// Listen binds the listeners up front so the bound port is observable via
+// Port/ProxyPort before Run is called. Run also calls this itself on a
+// reload (cancel ctx, call Run again), since the previous Run's servers
+// close these listeners as they shut down.
+func (gs *grpcServer) Listen() (grpcLn net.Listener, httpLn net.Listener, err error) {
+	if gs.enableMux && gs.enableGateway {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", gs.port))
+		if err != nil {
+			return nil, nil, err
+		}
+		// The root listener carries both protocols here, so MaxConnections
+		// caps their combined connection count rather than gRPC alone.
+		lis = gs.wrapGrpcListener(lis)
+		gs.rootLn = lis
+
+		gs.port = lis.Addr().(*net.TCPAddr).Port
+		gs.proxyPort = gs.port
 
-	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", gs.port), opts...)
+		gs.muxer = cmux.New(lis)
+		gs.grpcLn = gs.muxer.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+		gs.httpLn = gs.muxer.Match(cmux.HTTP1Fast(), cmux.HTTP2())
+
+		return gs.grpcLn, gs.httpLn, nil
+	}
+
+	grpcLis, err := net.Listen("tcp", fmt.Sprintf(":%d", gs.port))
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, nil, err
+	}
+	gs.grpcLn = gs.wrapGrpcListener(grpcLis)
+	gs.port = grpcLis.Addr().(*net.TCPAddr).Port
+
+	if gs.enableGateway {
+		httpLis, err := net.Listen("tcp", gs.gSrvGateway.Addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		gs.httpLn = gs.wrapListener(httpLis)
+		gs.proxyPort = httpLis.Addr().(*net.TCPAddr).Port
+	}
+
+	return gs.grpcLn, gs.httpLn, nil
+}
+
+func (gs *grpcServer) Port() int {
+	return gs.port
+}
+
+func (gs *grpcServer) ProxyPort() int {
+	return gs.proxyPort
+}
+
+func (gs *grpcServer) Run(ctx context.Context) {
+	// grpc.Server, http.Server, and cmux.CMux are all one-shot: once the
+	// previous Run's Serve call returns, it closes the listener(s) it was
+	// given, so a reload (cancel ctx, call Run again) needs fresh listeners
+	// and fresh servers, not a reuse of the ones from the prior call.
+	if gs.grpcLn == nil || gs.servicesRegistered {
+		if _, _, err := gs.Listen(); err != nil {
+			log.Fatal(fmt.Errorf("server listen error:%s", err.Error()))
+		}
+	}
+
+	gs.gSrv = gs.newGrpcServerInstance()
+	if gs.enableGateway {
+		gs.gSrvGateway = gs.newGatewayServerInstance()
 	}
 
 	for i := range gs.serviceList {
@@ -130,12 +444,22 @@ func (gs *grpcServer) Run(ctx context.Context) {
 
 		gs.gSrv.RegisterService(&desc.GrpcServiceDesc[i], gs.serviceList[i])
 
-		for _, f := range desc.GrpcGateway {
-			if err := f(context.Background(), gs.gatewayMux, conn); err != nil {
-				log.Fatal(err.Error())
+		if !gs.servicesRegistered {
+			gs.inproc.RegisterService(&desc.GrpcServiceDesc[i], gs.serviceList[i])
+
+			for _, f := range desc.GrpcGateway {
+				if err := f(context.Background(), gs.gatewayMux, gs.inproc); err != nil {
+					log.Fatal(err.Error())
+				}
 			}
 		}
 	}
+	gs.servicesRegistered = true
+
+	if gs.enableMux && gs.enableGateway {
+		gs.runMux(ctx)
+		return
+	}
 
 	wg := sync.WaitGroup{}
 
@@ -160,16 +484,78 @@ func (gs *grpcServer) Run(ctx context.Context) {
 	wg.Wait()
 }
 
-func (gs *grpcServer) run(ctx context.Context) error {
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", gs.port))
-	if err != nil {
-		return err
+func (gs *grpcServer) runMux(ctx context.Context) {
+	grpcL, httpL := gs.grpcLn, gs.httpLn
+
+	go func() {
+		<-ctx.Done()
+		logger.Info(logger.NewEntry().WithMessage(fmt.Sprintf("rpc server stop listen on: [%d]", gs.port)))
+		gs.setAllServing(healthpb.HealthCheckResponse_NOT_SERVING)
+		gs.gSrv.GracefulStop()
+
+		if err := gs.gSrvGateway.Shutdown(context.Background()); err != nil {
+			logger.Error(logger.NewEntry().WithMessage(fmt.Sprintf("failed to shutdown http server: %s", err.Error())))
+		}
+
+		// cmux.CMux has no Close of its own; closing the root listener it
+		// was built on is what unblocks gs.muxer.Serve()'s Accept loop below.
+		if err := gs.rootLn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error(logger.NewEntry().WithMessage(fmt.Sprintf("failed to close root listener: %s", err.Error())))
+		}
+	}()
+
+	if gs.register != nil {
+		for i := range gs.serviceList {
+			node := discovery.NewNode(gs.host, gs.port, discovery.GRPC, gs.serviceList[i])
+			if err := gs.register.Register(node); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+	}
+
+	gs.setAllServing(healthpb.HealthCheckResponse_SERVING)
+
+	logger.Info(logger.NewEntry().WithMessage(fmt.Sprintf("rpc server start listen on: [%d] (muxed)", gs.port)))
+
+	var eg errgroup.Group
+
+	eg.Go(func() error {
+		return gs.gSrv.Serve(grpcL)
+	})
+
+	eg.Go(func() error {
+		var err error
+		if gs.tlsConfig != nil {
+			err = gs.gSrvGateway.ServeTLS(httpL, "", "")
+		} else {
+			err = gs.gSrvGateway.Serve(httpL)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		if err := gs.muxer.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		return nil
+	})
+
+	if err := eg.Wait(); err != nil {
+		log.Fatal(fmt.Errorf("server run error:%s", err.Error()))
 	}
+}
+
+func (gs *grpcServer) run(ctx context.Context) error {
+	lis := gs.grpcLn
 
 	go func() {
 		select {
 		case <-ctx.Done():
 			logger.Info(logger.NewEntry().WithMessage(fmt.Sprintf("rpc server stop listen on: [%d]", gs.port)))
+			gs.setAllServing(healthpb.HealthCheckResponse_NOT_SERVING)
 			gs.gSrv.GracefulStop()
 		}
 	}()
@@ -183,6 +569,8 @@ func (gs *grpcServer) run(ctx context.Context) error {
 		}
 	}
 
+	gs.setAllServing(healthpb.HealthCheckResponse_SERVING)
+
 	logger.Info(logger.NewEntry().WithMessage(fmt.Sprintf("rpc server start listen on: [%d]", gs.port)))
 
 	if err := gs.gSrv.Serve(lis); err != nil {
@@ -216,7 +604,14 @@ func (gs *grpcServer) runGateway(ctx context.Context) error {
 	}
 	logger.Info(logger.NewEntry().WithMessage(fmt.Sprintf("rpc server gateway start listen on: [%d]", gs.proxyPort)))
 
-	if err := gs.gSrvGateway.ListenAndServe(); err != http.ErrServerClosed {
+	var err error
+	if gs.tlsConfig != nil {
+		err = gs.gSrvGateway.ServeTLS(gs.httpLn, "", "")
+	} else {
+		err = gs.gSrvGateway.Serve(gs.httpLn)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
 		//s.l.Panic(logger.NewEntry().WithMessage(fmt.Sprintf("failed to listen and serve: %s", err.Error())).End())
 		return err
 	}
@@ -225,5 +620,38 @@ func (gs *grpcServer) runGateway(ctx context.Context) error {
 }
 
 func (gs *grpcServer) findListenOn() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+
+			ip = ip.To4()
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+
+			return ip.String()
+		}
+	}
+
 	return ""
-}
\ No newline at end of file
+}
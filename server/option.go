@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/ringbrew/gsv/discovery"
+	"github.com/ringbrew/gsv/tracex"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/stats"
+)
+
+// Option configures a grpc server created by newGrpcServer.
+type Option struct {
+	Port      int
+	ProxyPort int
+
+	StreamInterceptors []grpc.StreamServerInterceptor
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StatHandler        stats.Handler
+
+	ServerRegister discovery.Register
+
+	EnableGrpcGateway bool
+	TraceOption       tracex.Option
+
+	// EnableMux serves gRPC and the grpc-gateway HTTP handler on a single
+	// TCP listener via cmux. It defaults to on when ProxyPort equals Port,
+	// since binding the same port twice would otherwise fail.
+	EnableMux bool
+
+	// TLSConfig, when set, enables TLS on both the gRPC server and the
+	// gateway HTTP server. ClientCAs and RequireClientCert additionally
+	// turn on mutual TLS.
+	TLSConfig         *tls.Config
+	ClientCAs         *x509.CertPool
+	RequireClientCert bool
+
+	// EnableProxyProtocol wraps the listener with a PROXY protocol decoder
+	// so that the real client IP survives an L4 load balancer hop.
+	EnableProxyProtocol bool
+
+	// EnableHealth registers the standard grpc.health.v1 service and mirrors
+	// it as /healthz and /readyz on the gateway mux.
+	EnableHealth bool
+	// EnableReflection registers the grpc reflection service, so tools like
+	// grpcurl can discover methods without a local copy of the proto.
+	EnableReflection bool
+	// EnableChannelz registers the channelz service for runtime introspection.
+	EnableChannelz bool
+
+	// MaxConcurrentStreams caps concurrent streams per client connection.
+	// Defaults to 1000 when zero.
+	MaxConcurrentStreams uint32
+	// MaxRecvMsgSize and MaxSendMsgSize bound message sizes. Both default to
+	// 4 MiB when zero; for receives that matches grpc-go's own default.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+
+	KeepaliveParams            keepalive.ServerParameters
+	KeepaliveEnforcementPolicy keepalive.EnforcementPolicy
+
+	// MaxConnections caps the number of simultaneously accepted connections
+	// on the gRPC listener, via netutil.LimitListener, so a runaway client
+	// can't exhaust file descriptors. In mux mode that listener is shared
+	// with the gateway, so HTTP connections count against the cap too.
+	// Zero means unlimited.
+	MaxConnections int
+}